@@ -0,0 +1,237 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package gircclient
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/DanielOaks/girc-go/eventmgr"
+	"github.com/DanielOaks/girc-go/ircmsg"
+)
+
+// Batch is an IRCv3 batch of related messages, grouped under a shared
+// reference tag from the "BATCH +id ..." that opened it to the
+// "BATCH -id" that closed it.
+type Batch struct {
+	Type     string
+	Params   []string
+	Messages []ircmsg.IRCMessage
+	Batches  []*Batch // batches nested inside this one
+}
+
+// pendingLabel is a label-tagged send awaiting its correlated response(s).
+type pendingLabel struct {
+	ch      chan []ircmsg.IRCMessage
+	created time.Time
+}
+
+// handleBatch opens or closes a tracked Batch in response to a BATCH
+// message, firing a "batch" event (and resolving any correlated
+// SendLabeled call) once the outermost batch in a nest closes.
+func (sc *ServerConnection) handleBatch(info eventmgr.InfoMap) {
+	params, _ := info["params"].([]string)
+	if len(params) < 1 || len(params[0]) < 2 {
+		return
+	}
+
+	sign := params[0][0]
+	reftag := params[0][1:]
+
+	switch sign {
+	case '+':
+		b := &Batch{}
+		if len(params) > 1 {
+			b.Type = params[1]
+		}
+		if len(params) > 2 {
+			b.Params = params[2:]
+		}
+
+		var label string
+		var hasLabel bool
+		var parentTag string
+		var hasParentTag bool
+		if tags, ok := info["tags"].(map[string]ircmsg.TagValue); ok {
+			if l, ok := tags["label"]; ok {
+				label, hasLabel = l.Value, true
+			}
+			// a nested batch's own "BATCH +id ..." line belongs to its
+			// parent batch, and carries that parent's reftag as its "batch"
+			// tag, just like any other line filed into a batch.
+			if p, ok := tags["batch"]; ok {
+				parentTag, hasParentTag = p.Value, true
+			}
+		}
+
+		sc.batchMu.Lock()
+		var nested bool
+		if hasParentTag {
+			if parent, ok := sc.openBatches[parentTag]; ok {
+				parent.Batches = append(parent.Batches, b)
+				nested = true
+			}
+		}
+
+		if sc.openBatches == nil {
+			sc.openBatches = make(map[string]*Batch)
+		}
+		if sc.batchNested == nil {
+			sc.batchNested = make(map[string]bool)
+		}
+		sc.openBatches[reftag] = b
+		sc.batchNested[reftag] = nested
+		sc.batchStack = append(sc.batchStack, reftag)
+
+		if hasLabel {
+			if sc.batchLabels == nil {
+				sc.batchLabels = make(map[string]string)
+			}
+			sc.batchLabels[reftag] = label
+		}
+		sc.batchMu.Unlock()
+
+	case '-':
+		sc.batchMu.Lock()
+		b, ok := sc.openBatches[reftag]
+		if !ok {
+			sc.batchMu.Unlock()
+			return
+		}
+		delete(sc.openBatches, reftag)
+		nested := sc.batchNested[reftag]
+		delete(sc.batchNested, reftag)
+
+		for i := len(sc.batchStack) - 1; i >= 0; i-- {
+			if sc.batchStack[i] == reftag {
+				sc.batchStack = append(sc.batchStack[:i], sc.batchStack[i+1:]...)
+				break
+			}
+		}
+
+		label, hasLabel := sc.batchLabels[reftag]
+		delete(sc.batchLabels, reftag)
+		sc.batchMu.Unlock()
+
+		// b.Messages is done changing: trackBatchedMessage only appends to
+		// it while reftag is still in sc.openBatches, which we just removed
+		// under the lock above.
+		if hasLabel {
+			sc.deliverLabel(label, b.Messages)
+		}
+
+		if !nested {
+			sc.dispatchBatchEvent(b)
+		}
+	}
+}
+
+func (sc *ServerConnection) dispatchBatchEvent(b *Batch) {
+	info := eventmgr.NewInfoMap()
+	info["server"] = sc
+	info["batch"] = b
+	sc.dispatchIn("batch", info)
+}
+
+// trackBatchedMessage files message into its batch (if its "batch" tag
+// references one we have open) and resolves any labeled-response waiter
+// that message alone satisfies. It's called for every inbound line, not
+// just BATCH itself.
+func (sc *ServerConnection) trackBatchedMessage(message ircmsg.IRCMessage) {
+	sc.batchMu.Lock()
+	if tag, ok := message.Tags["batch"]; ok {
+		if b, ok := sc.openBatches[tag.Value]; ok {
+			b.Messages = append(b.Messages, message)
+		}
+	}
+	sc.expireLabelsLocked()
+	sc.batchMu.Unlock()
+
+	label, ok := message.Tags["label"]
+	if !ok {
+		return
+	}
+
+	// a label on a "BATCH +id ..." line is resolved when that batch
+	// closes (see handleBatch), not immediately
+	if strings.EqualFold(message.Command, "BATCH") && len(message.Params) > 0 && message.Params[0] != "" && message.Params[0][0] == '+' {
+		return
+	}
+
+	sc.deliverLabel(label.Value, []ircmsg.IRCMessage{message})
+}
+
+// deliverLabel hands messages to the pending SendLabeled call waiting on
+// label, if there is one.
+func (sc *ServerConnection) deliverLabel(label string, messages []ircmsg.IRCMessage) {
+	sc.batchMu.Lock()
+	pending, ok := sc.pendingLabels[label]
+	if ok {
+		delete(sc.pendingLabels, label)
+	}
+	sc.batchMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case pending.ch <- messages:
+	default:
+	}
+}
+
+// expireLabelsLocked drops any pending labels older than LabelTimeout,
+// closing their channel so a waiting caller unblocks with no results.
+// sc.batchMu must be held.
+func (sc *ServerConnection) expireLabelsLocked() {
+	if sc.LabelTimeout <= 0 || len(sc.pendingLabels) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for label, pending := range sc.pendingLabels {
+		if now.Sub(pending.created) > sc.LabelTimeout {
+			delete(sc.pendingLabels, label)
+			close(pending.ch)
+		}
+	}
+}
+
+// SendLabeled sends command/params with a unique "label" tag attached and
+// returns a channel that fires once with the response: a single message
+// tagged with the matching label, or, when the label is on a BATCH, the
+// messages filed into that batch once it closes. The BATCH +/- lines
+// themselves, and the messages of batches nested inside it, are not part
+// of what the channel delivers. This lets callers
+// write request/response code (WHO, NAMES, chathistory) without racing
+// against unrelated traffic.
+//
+// SendLabeled is safe to call from any goroutine: it shares pendingLabels
+// with the read loop's batch/label handling, guarded by sc.batchMu.
+func (sc *ServerConnection) SendLabeled(command string, params ...string) (<-chan []ircmsg.IRCMessage, error) {
+	sc.batchMu.Lock()
+	sc.expireLabelsLocked()
+
+	sc.labelCounter++
+	label := fmt.Sprintf("gircclient-%d-%d", time.Now().UnixNano(), sc.labelCounter)
+	pending := &pendingLabel{ch: make(chan []ircmsg.IRCMessage, 1), created: time.Now()}
+
+	if sc.pendingLabels == nil {
+		sc.pendingLabels = make(map[string]*pendingLabel)
+	}
+	sc.pendingLabels[label] = pending
+	sc.batchMu.Unlock()
+
+	tags := map[string]ircmsg.TagValue{"label": {Value: label, HasValue: true}}
+	if err := sc.Send(&tags, "", command, params...); err != nil {
+		sc.batchMu.Lock()
+		delete(sc.pendingLabels, label)
+		sc.batchMu.Unlock()
+		return nil, err
+	}
+
+	return pending.ch, nil
+}
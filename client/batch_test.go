@@ -0,0 +1,143 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package gircclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DanielOaks/girc-go/eventmgr"
+	"github.com/DanielOaks/girc-go/ircmsg"
+)
+
+func TestHandleBatchCollectsMessagesAndFiresOnClose(t *testing.T) {
+	sc := &ServerConnection{}
+
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"+123", "chathistory", "#ircv3"}})
+
+	msg := ircmsg.IRCMessage{Command: "PRIVMSG", Params: []string{"#ircv3", "hi"}, Tags: map[string]ircmsg.TagValue{"batch": {Value: "123", HasValue: true}}}
+	sc.trackBatchedMessage(msg)
+
+	var got *Batch
+	sc.RegisterEvent("in", "batch", func(info eventmgr.InfoMap) {
+		got, _ = info["batch"].(*Batch)
+	}, 0)
+
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"-123"}})
+
+	if got == nil {
+		t.Fatal("batch event was never dispatched")
+	}
+	if got.Type != "chathistory" {
+		t.Errorf("Batch.Type = %q, want %q", got.Type, "chathistory")
+	}
+	if len(got.Messages) != 1 || got.Messages[0].Command != "PRIVMSG" {
+		t.Fatalf("Batch.Messages = %+v, want one PRIVMSG", got.Messages)
+	}
+	if len(sc.openBatches) != 0 || len(sc.batchStack) != 0 {
+		t.Errorf("batch state left open after close: openBatches=%v batchStack=%v", sc.openBatches, sc.batchStack)
+	}
+}
+
+func TestHandleBatchNestedOnlyFiresOutermost(t *testing.T) {
+	sc := &ServerConnection{}
+
+	var fired []string
+	sc.RegisterEvent("in", "batch", func(info eventmgr.InfoMap) {
+		b, _ := info["batch"].(*Batch)
+		fired = append(fired, b.Type)
+	}, 0)
+
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"+outer", "netjoin"}})
+	sc.handleBatch(eventmgr.InfoMap{
+		"params": []string{"+inner", "netsplit"},
+		"tags":   map[string]ircmsg.TagValue{"batch": {Value: "outer", HasValue: true}},
+	})
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"-inner"}})
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"-outer"}})
+
+	if len(fired) != 1 || fired[0] != "netjoin" {
+		t.Fatalf("batch events fired = %v, want only the outer batch", fired)
+	}
+}
+
+func TestHandleBatchIndependentTopLevelBatchesBothFire(t *testing.T) {
+	sc := &ServerConnection{}
+
+	var fired []string
+	sc.RegisterEvent("in", "batch", func(info eventmgr.InfoMap) {
+		b, _ := info["batch"].(*Batch)
+		fired = append(fired, b.Type)
+	}, 0)
+
+	// two top-level batches open at once, interleaved, neither referencing
+	// the other via a "batch" tag: they must not be mistaken for nested.
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"+first", "netjoin"}})
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"+second", "netsplit"}})
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"-first"}})
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"-second"}})
+
+	if len(fired) != 2 {
+		t.Fatalf("batch events fired = %v, want both independent top-level batches", fired)
+	}
+}
+
+func TestHandleBatchDeliversLabelOnClose(t *testing.T) {
+	sc := &ServerConnection{}
+	pending := &pendingLabel{ch: make(chan []ircmsg.IRCMessage, 1), created: time.Now()}
+	sc.pendingLabels = map[string]*pendingLabel{"mylabel": pending}
+
+	sc.handleBatch(eventmgr.InfoMap{
+		"params": []string{"+abc", "chathistory"},
+		"tags":   map[string]ircmsg.TagValue{"label": {Value: "mylabel", HasValue: true}},
+	})
+	msg := ircmsg.IRCMessage{Command: "PRIVMSG", Tags: map[string]ircmsg.TagValue{"batch": {Value: "abc", HasValue: true}}}
+	sc.trackBatchedMessage(msg)
+	sc.handleBatch(eventmgr.InfoMap{"params": []string{"-abc"}})
+
+	select {
+	case msgs := <-pending.ch:
+		if len(msgs) != 1 {
+			t.Errorf("delivered %d messages, want 1", len(msgs))
+		}
+	default:
+		t.Fatal("label was never delivered")
+	}
+}
+
+func TestTrackBatchedMessageDeliversUnbatchedLabel(t *testing.T) {
+	sc := &ServerConnection{}
+	pending := &pendingLabel{ch: make(chan []ircmsg.IRCMessage, 1), created: time.Now()}
+	sc.pendingLabels = map[string]*pendingLabel{"mylabel": pending}
+
+	msg := ircmsg.IRCMessage{Command: "WHOIS", Tags: map[string]ircmsg.TagValue{"label": {Value: "mylabel", HasValue: true}}}
+	sc.trackBatchedMessage(msg)
+
+	select {
+	case msgs := <-pending.ch:
+		if len(msgs) != 1 || msgs[0].Command != "WHOIS" {
+			t.Errorf("delivered %+v, want one WHOIS message", msgs)
+		}
+	default:
+		t.Fatal("label was never delivered")
+	}
+}
+
+func TestExpireLabelsLockedClosesStaleLabels(t *testing.T) {
+	sc := &ServerConnection{LabelTimeout: time.Minute}
+	stale := &pendingLabel{ch: make(chan []ircmsg.IRCMessage, 1), created: time.Now().Add(-time.Hour)}
+	fresh := &pendingLabel{ch: make(chan []ircmsg.IRCMessage, 1), created: time.Now()}
+	sc.pendingLabels = map[string]*pendingLabel{"stale": stale, "fresh": fresh}
+
+	sc.batchMu.Lock()
+	sc.expireLabelsLocked()
+	sc.batchMu.Unlock()
+
+	if _, open := <-stale.ch; open {
+		t.Error("stale label's channel should have been closed")
+	}
+	if _, stillPending := sc.pendingLabels["fresh"]; !stillPending {
+		t.Error("fresh label should not have been expired")
+	}
+}
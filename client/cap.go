@@ -0,0 +1,146 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package gircclient
+
+import (
+	"strings"
+
+	"github.com/DanielOaks/girc-go/eventmgr"
+)
+
+// capState tracks where we are in IRCv3 capability negotiation for the
+// current connection attempt.
+type capState struct {
+	requested map[string]bool // caps we've sent CAP REQ for, awaiting ACK/NAK
+	acked     map[string]bool // caps the server ACKed
+}
+
+// handleCAP dispatches an incoming CAP message to the right subcommand
+// handler.
+func (sc *ServerConnection) handleCAP(info eventmgr.InfoMap) {
+	params, _ := info["params"].([]string)
+	if len(params) < 2 {
+		return
+	}
+
+	switch strings.ToUpper(params[1]) {
+	case "LS":
+		sc.handleCapLS(params[2:])
+	case "ACK":
+		sc.handleCapACK(params[2:])
+	case "NAK":
+		sc.handleCapNAK(params[2:])
+	}
+}
+
+// handleCapLS accumulates the server's advertised capabilities, handling
+// the "CAP * LS :..." multiline continuation form, and requests the ones we
+// want once the final line of the list arrives.
+func (sc *ServerConnection) handleCapLS(rest []string) {
+	var capList string
+	more := false
+
+	if len(rest) > 1 && rest[0] == "*" {
+		more = true
+		capList = rest[1]
+	} else if len(rest) > 0 {
+		capList = rest[0]
+	}
+
+	for _, token := range strings.Fields(capList) {
+		name := token
+		if i := strings.IndexByte(token, '='); i >= 0 {
+			name = token[:i]
+		}
+		sc.serverCaps = append(sc.serverCaps, name)
+	}
+
+	if more {
+		return
+	}
+
+	sc.requestWantedCaps()
+}
+
+// requestWantedCaps sends a CAP REQ for every wanted capability the server
+// actually supports, or proceeds straight to CAP END if there's nothing to
+// request.
+func (sc *ServerConnection) requestWantedCaps() {
+	sc.capNegotiation.requested = make(map[string]bool)
+	sc.capNegotiation.acked = make(map[string]bool)
+
+	var req []string
+	for _, want := range sc.Caps.Wanted() {
+		if sc.serverSupportsCap(want) {
+			req = append(req, want)
+			sc.capNegotiation.requested[want] = true
+		}
+	}
+
+	if len(req) == 0 {
+		sc.finishCapNegotiation()
+		return
+	}
+
+	sc.Send(nil, "", "CAP", "REQ", strings.Join(req, " "))
+}
+
+func (sc *ServerConnection) serverSupportsCap(name string) bool {
+	for _, c := range sc.serverCaps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCapACK processes the server's acknowledgement of requested caps,
+// kicking off SASL if "sasl" was just acked.
+func (sc *ServerConnection) handleCapACK(rest []string) {
+	if len(rest) == 0 {
+		return
+	}
+
+	for _, name := range strings.Fields(rest[0]) {
+		delete(sc.capNegotiation.requested, name)
+		sc.capNegotiation.acked[name] = true
+
+		if name == "sasl" && sc.wantsSASL() {
+			sc.startSASL()
+		}
+	}
+
+	sc.maybeFinishCapNegotiation()
+}
+
+// handleCapNAK processes the server's rejection of requested caps.
+func (sc *ServerConnection) handleCapNAK(rest []string) {
+	if len(rest) == 0 {
+		return
+	}
+
+	for _, name := range strings.Fields(rest[0]) {
+		delete(sc.capNegotiation.requested, name)
+	}
+
+	sc.maybeFinishCapNegotiation()
+}
+
+// maybeFinishCapNegotiation sends CAP END and proceeds to registration once
+// every requested cap has been ACKed/NAKed and SASL (if any) has settled.
+func (sc *ServerConnection) maybeFinishCapNegotiation() {
+	if len(sc.capNegotiation.requested) > 0 || sc.saslInProgress {
+		return
+	}
+
+	sc.finishCapNegotiation()
+}
+
+// finishCapNegotiation ends capability negotiation and sends the NICK/USER
+// pair to register.
+func (sc *ServerConnection) finishCapNegotiation() {
+	sc.Send(nil, "", "CAP", "END")
+	sc.Send(nil, "", "NICK", sc.InitialNick)
+	sc.Send(nil, "", "USER", sc.InitialUser, "0", "*", sc.InitialRealName)
+}
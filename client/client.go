@@ -7,30 +7,125 @@ import (
 	"bufio"
 	"crypto/tls"
 	"errors"
-	"fmt"
 	"net"
-	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DanielOaks/girc-go/eventmgr"
 	"github.com/DanielOaks/girc-go/ircmsg"
+	"github.com/DanielOaks/girc-go/isupport"
+	"github.com/DanielOaks/girc-go/tracker"
 )
 
+// sendQueueSize is how many outgoing messages may be buffered in pwrite
+// before Send starts blocking the caller.
+const sendQueueSize = 64
+
+// maxReconnectDelay caps the exponential backoff used between reconnection
+// attempts.
+const maxReconnectDelay = 5 * time.Minute
+
 // ServerConnection is a connection to a single server.
 type ServerConnection struct {
-	Name       string
-	Connected  bool
+	Name string
+
+	// connected tracks Connected; it's written by the read/dial/reconnect
+	// goroutine and read by keepaliveLoop, so it's kept atomic rather than
+	// a plain bool.
+	connected  atomic.Bool
 	Registered bool
 
+	// Timeout is how long we wait for a reply to a keepalive PING before
+	// giving up on the connection. KeepAlive is how long the connection can
+	// sit idle before we send that keepalive PING. ReconnectFreq is the base
+	// delay used for reconnection backoff; if zero, we don't reconnect.
+	Timeout       time.Duration
+	KeepAlive     time.Duration
+	ReconnectFreq time.Duration
+
+	// SendRate and Burst configure the token-bucket flood protection used by
+	// the send queue: Burst messages may be sent back-to-back, after which
+	// sends are spaced SendRate apart. MaxLineLen, if set, is the maximum
+	// length (not including tags) of a serialized outgoing line; Send
+	// truncates the trailing parameter to fit. A server-advertised ISUPPORT
+	// LINELEN takes precedence over MaxLineLen.
+	SendRate   time.Duration
+	Burst      int
+	MaxLineLen int
+
+	// SASLLogin and SASLPassword are the credentials to authenticate with;
+	// leaving SASLLogin empty disables SASL unless SASLMech is "EXTERNAL",
+	// whose authzid may be left empty. SASLMech selects the mechanism
+	// ("PLAIN", "EXTERNAL", or "SCRAM-SHA-256"), defaulting to "PLAIN".
+	// EXTERNAL reuses the client certificate passed to Connect.
+	SASLLogin    string
+	SASLPassword string
+	SASLMech     string
+
+	// Version is reported in response to a CTCP VERSION request.
+	// CTCPDefaults toggles the built-in PING/VERSION/TIME/CLIENTINFO/
+	// SOURCE/USERINFO responders.
+	Version      string
+	CTCPDefaults bool
+
 	// internal stuff
 	connection net.Conn
 	eventsIn   eventmgr.EventManager
 	eventsOut  eventmgr.EventManager
 
+	serverCaps     []string // caps the server advertised in CAP LS
+	capNegotiation capState
+
+	saslInProgress bool
+	saslMechInUse  string
+	saslChan       chan saslResult
+	scram          *scramClient
+
+	tracker tracker.Tracker
+
+	ctcpHandlers map[string]func(sc *ServerConnection, ev CTCPEvent)
+	ctcpLimiter  map[string]time.Time
+
+	// LabelTimeout bounds how long SendLabeled will wait for a correlated
+	// response before giving up on it.
+	LabelTimeout time.Duration
+
+	// batchMu guards the following batch/label fields, since SendLabeled is
+	// called from callers' goroutines while the rest are driven by the read
+	// loop.
+	batchMu       sync.Mutex
+	openBatches   map[string]*Batch
+	batchNested   map[string]bool
+	batchStack    []string
+	batchLabels   map[string]string // open batch reftag -> label that resolves when it closes
+	labelCounter  uint64
+	pendingLabels map[string]*pendingLabel
+
+	address   string
+	ssl       bool
+	tlsconfig *tls.Config
+
+	// quit records that Shutdown was called, so reconnect doesn't redial; it's
+	// written by Shutdown and read by ReceiveLoop/reconnect from another
+	// goroutine, so it's kept atomic rather than a plain bool.
+	quit atomic.Bool
+
+	// pingSent and lastActivity are written by readLoop and read (pingSent
+	// also written) by keepaliveLoop, which run concurrently, so both are
+	// atomic; lastActivity stores a UnixNano timestamp.
+	pingSent     atomic.Bool
+	lastActivity atomic.Int64
+
+	pwrite  chan []byte // outgoing lines, consumed by writerLoop
+	end     chan struct{}
+	endOnce sync.Once
+	wg      sync.WaitGroup
+
 	// data we keep track of
-	// Features ServerFeatures
-	Caps ClientCapabilities
+	Features isupport.ServerFeatures
+	Caps     ClientCapabilities
 
 	// details users must supply before connection
 	Nick            string
@@ -39,6 +134,12 @@ type ServerConnection struct {
 	InitialRealName string
 }
 
+// Connected reports whether the connection is currently established. It's
+// safe to call from any goroutine.
+func (sc *ServerConnection) Connected() bool {
+	return sc.connected.Load()
+}
+
 // newServerConnection returns an initialised ServerConnection, for internal
 // use.
 func newServerConnection(name string) *ServerConnection {
@@ -49,10 +150,39 @@ func newServerConnection(name string) *ServerConnection {
 
 	sc.Caps.AddWantedCaps("account-notify", "away-notify", "extended-join", "multi-prefix", "sasl")
 	sc.Caps.AddWantedCaps("account-tag", "chghost", "echo-message", "invite-notify", "server-time", "userhost-in-names")
+	sc.Caps.AddWantedCaps("batch", "labeled-response")
+
+	sc.RegisterEvent("in", "CAP", sc.handleCAP, 0)
+	sc.RegisterEvent("in", "AUTHENTICATE", sc.handleAuthenticate, 0)
+	for _, numeric := range []string{"900", "903", "904", "905", "906", "907"} {
+		sc.RegisterEvent("in", numeric, sc.handleSASLNumeric, 0)
+	}
+	sc.RegisterEvent("in", "005", sc.handleISupport, 0)
+	sc.registerTrackerEvents()
+	sc.registerCTCP()
+	sc.RegisterEvent("in", "BATCH", sc.handleBatch, 0)
 
 	return &sc
 }
 
+// handleISupport parses an RPL_ISUPPORT (005) numeric into sc.Features.
+func (sc *ServerConnection) handleISupport(info eventmgr.InfoMap) {
+	params, _ := info["params"].([]string)
+	if len(params) < 2 {
+		return
+	}
+
+	// params[0] is our nick; when there's more than one token left, the
+	// last one is the human-readable ":are supported by this server"
+	// comment rather than an ISUPPORT token.
+	tokens := params[1:]
+	if len(tokens) > 1 {
+		tokens = tokens[:len(tokens)-1]
+	}
+
+	sc.Features.Apply(tokens)
+}
+
 // Connect connects to the given address.
 func (sc *ServerConnection) Connect(address string, ssl bool, tlsconfig *tls.Config) error {
 	// check the required attributes
@@ -60,14 +190,23 @@ func (sc *ServerConnection) Connect(address string, ssl bool, tlsconfig *tls.Con
 		return errors.New("InitialNick and InitialUser must be set before connecting")
 	}
 
-	// connect
+	sc.address = address
+	sc.ssl = ssl
+	sc.tlsconfig = tlsconfig
+
+	return sc.dial()
+}
+
+// dial opens the TCP (or TLS) connection and kicks off registration. It's
+// used both for the initial Connect and for every reconnection attempt.
+func (sc *ServerConnection) dial() error {
 	var conn net.Conn
 	var err error
 
-	if ssl {
-		conn, err = tls.Dial("tcp", address, tlsconfig)
+	if sc.ssl {
+		conn, err = tls.Dial("tcp", sc.address, sc.tlsconfig)
 	} else {
-		conn, err = net.Dial("tcp", address)
+		conn, err = net.Dial("tcp", sc.address)
 	}
 
 	if err != nil {
@@ -75,14 +214,55 @@ func (sc *ServerConnection) Connect(address string, ssl bool, tlsconfig *tls.Con
 	}
 
 	sc.connection = conn
-	sc.Connected = true
+	sc.connected.Store(true)
+	sc.Registered = false
+	sc.pingSent.Store(false)
+	sc.lastActivity.Store(time.Now().UnixNano())
+
+	sc.serverCaps = nil
+	sc.capNegotiation = capState{}
+	sc.saslInProgress = false
+	sc.scram = nil
+	sc.Features = isupport.ServerFeatures{}
+	sc.tracker.Reset()
+
+	sc.batchMu.Lock()
+	for _, pending := range sc.pendingLabels {
+		close(pending.ch)
+	}
+	sc.openBatches = nil
+	sc.batchNested = nil
+	sc.batchStack = nil
+	sc.batchLabels = nil
+	sc.pendingLabels = nil
+	sc.batchMu.Unlock()
+
+	sc.pwrite = make(chan []byte, sendQueueSize)
+	sc.end = make(chan struct{})
+	sc.endOnce = sync.Once{}
+
+	sc.wg.Add(1)
+	go sc.writerLoop(sc.pwrite, sc.end)
 
 	sc.Send(nil, "", "CAP", "LS", "302")
 
+	sc.dispatchConnectionEvent("connected")
+
 	return nil
 }
 
-// ReceiveLoop runs a loop of receiving and dispatching new messages.
+// stopWriters closes the send queue's end channel (at most once) and waits
+// for the writer and keepalive goroutines to finish.
+func (sc *ServerConnection) stopWriters() {
+	sc.endOnce.Do(func() {
+		close(sc.end)
+	})
+	sc.wg.Wait()
+}
+
+// ReceiveLoop runs a loop of receiving and dispatching new messages,
+// reconnecting (with exponential backoff) while ReconnectFreq is set and
+// Shutdown has not been called.
 func (sc *ServerConnection) ReceiveLoop() {
 	// wait for the connection to become available
 	for sc.connection == nil {
@@ -90,16 +270,48 @@ func (sc *ServerConnection) ReceiveLoop() {
 		time.Sleep(waitTime)
 	}
 
+	for {
+		sc.readLoop()
+
+		sc.stopWriters()
+		sc.connection.Close()
+		sc.connected.Store(false)
+		sc.dispatchConnectionEvent("disconnected")
+
+		if sc.quit.Load() || sc.ReconnectFreq <= 0 {
+			break
+		}
+
+		sc.reconnect()
+	}
+}
+
+// readLoop reads and dispatches messages for a single connection attempt,
+// sending a keepalive PING after KeepAlive seconds of inactivity and
+// returning once the socket errors out, including when no traffic at all
+// (not even a PONG) arrives within KeepAlive+Timeout.
+func (sc *ServerConnection) readLoop() {
+	if sc.KeepAlive > 0 {
+		sc.wg.Add(1)
+		go sc.keepaliveLoop(sc.end)
+	}
+
 	reader := bufio.NewReader(sc.connection)
 
 	for {
+		if sc.KeepAlive > 0 {
+			sc.connection.SetReadDeadline(time.Now().Add(sc.KeepAlive + sc.Timeout))
+		}
+
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			sc.Connected = false
-			break
+			return
 		}
 		line = strings.Trim(line, "\r\n")
 
+		sc.lastActivity.Store(time.Now().UnixNano())
+		sc.pingSent.Store(false)
+
 		// ignore empty lines
 		if len(line) < 1 {
 			continue
@@ -122,11 +334,68 @@ func (sc *ServerConnection) ReceiveLoop() {
 		info["command"] = message.Command
 		info["params"] = message.Params
 
+		sc.trackBatchedMessage(message)
+
 		// IRC commands are case-insensitive
 		sc.dispatchIn(strings.ToUpper(message.Command), info)
 	}
+}
 
-	sc.connection.Close()
+// keepaliveLoop sends a PING once the connection has been idle for
+// KeepAlive, so that a dead socket gets noticed instead of blocking
+// ReceiveLoop forever.
+func (sc *ServerConnection) keepaliveLoop(end chan struct{}) {
+	defer sc.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-end:
+			return
+		case <-ticker.C:
+			idleSince := time.Unix(0, sc.lastActivity.Load())
+			if sc.connected.Load() && !sc.pingSent.Load() && time.Since(idleSince) >= sc.KeepAlive {
+				sc.pingSent.Store(true)
+				sc.Send(nil, "", "PING", sc.Name)
+			}
+		}
+	}
+}
+
+// reconnect re-dials the server with an exponential backoff (capped at
+// maxReconnectDelay), emitting a "reconnecting" event before each attempt.
+// It bails without dialing if Shutdown is called while it's sleeping.
+func (sc *ServerConnection) reconnect() {
+	delay := sc.ReconnectFreq
+
+	for {
+		sc.dispatchConnectionEvent("reconnecting")
+		time.Sleep(delay)
+
+		if sc.quit.Load() {
+			return
+		}
+
+		if err := sc.dial(); err == nil {
+			return
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// dispatchConnectionEvent fires a connection-lifecycle event ("connected",
+// "disconnected", or "reconnecting") so callers can react to liveness
+// changes.
+func (sc *ServerConnection) dispatchConnectionEvent(name string) {
+	info := eventmgr.NewInfoMap()
+	info["server"] = sc
+	sc.dispatchIn(name, info)
 }
 
 // RegisterEvent registers a new handler for the given event.
@@ -144,29 +413,43 @@ func (sc *ServerConnection) RegisterEvent(direction string, name string, handler
 	}
 }
 
-// Shutdown closes the connection to the server.
+// Shutdown closes the connection to the server. It will not be reconnected,
+// even if ReconnectFreq is set.
 func (sc *ServerConnection) Shutdown(message string) {
+	sc.quit.Store(true)
 	sc.Send(nil, "", "QUIT", message)
-	sc.Connected = false
+	sc.stopWriters()
+	sc.connected.Store(false)
 	sc.connection.Close()
 }
 
-// Send sends an IRC message to the server.
-func (sc *ServerConnection) Send(tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) {
-	ircmsg := ircmsg.MakeMessage(tags, prefix, command, params...)
-	line, err := ircmsg.Line()
+// Send marshals and queues an IRC message to be written to the server,
+// truncating its trailing parameter to fit MaxLineLen if necessary. It
+// returns an error if the message can't be marshalled, or if the
+// connection has already been shut down.
+func (sc *ServerConnection) Send(tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) error {
+	msg := ircmsg.MakeMessage(tags, prefix, command, params...)
+	truncateLine(&msg, sc.effectiveMaxLineLen())
+
+	line, err := msg.Line()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
-	fmt.Fprintf(sc.connection, line)
 
-	// dispatch raw event
-	info := eventmgr.NewInfoMap()
-	info["server"] = sc
-	info["direction"] = "out"
-	info["data"] = line
-	sc.dispatchRawOut(info)
+	// checked first so that a shut-down connection with room left in pwrite
+	// can't have the line queued instead
+	select {
+	case <-sc.end:
+		return errors.New("connection is shut down")
+	default:
+	}
+
+	select {
+	case sc.pwrite <- []byte(line):
+		return nil
+	case <-sc.end:
+		return errors.New("connection is shut down")
+	}
 }
 
 // dispatchRawIn dispatches raw inbound messages.
@@ -0,0 +1,156 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package gircclient
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DanielOaks/girc-go/ctcp"
+	"github.com/DanielOaks/girc-go/eventmgr"
+)
+
+// ctcpReplyInterval is the minimum time between our CTCP replies to the
+// same target, to avoid being used to amplify a flood against it.
+const ctcpReplyInterval = 2 * time.Second
+
+// CTCPEvent describes one received CTCP request or reply.
+type CTCPEvent struct {
+	Command string
+	Args    string
+	Nick    string
+	User    string
+	Host    string
+	Target  string // the channel, or our own nick, the message was sent to
+	Reply   bool   // true for a NOTICE (a CTCP reply), false for a PRIVMSG (a CTCP request)
+}
+
+// RegisterCTCP registers handler to be called whenever a CTCP message with
+// the given command name (case-insensitive) is received.
+func (sc *ServerConnection) RegisterCTCP(name string, handler func(sc *ServerConnection, ev CTCPEvent)) {
+	if sc.ctcpHandlers == nil {
+		sc.ctcpHandlers = make(map[string]func(sc *ServerConnection, ev CTCPEvent))
+	}
+	sc.ctcpHandlers[strings.ToUpper(name)] = handler
+}
+
+// registerCTCP wires up CTCP dispatch and the default responders. Called
+// once from newServerConnection.
+func (sc *ServerConnection) registerCTCP() {
+	sc.RegisterEvent("in", "PRIVMSG", sc.handleCTCPMessage, 0)
+	sc.RegisterEvent("in", "NOTICE", sc.handleCTCPMessage, 0)
+
+	sc.RegisterCTCP("PING", defaultCTCPPing)
+	sc.RegisterCTCP("VERSION", defaultCTCPVersion)
+	sc.RegisterCTCP("TIME", defaultCTCPTime)
+	sc.RegisterCTCP("CLIENTINFO", defaultCTCPClientInfo)
+	sc.RegisterCTCP("SOURCE", defaultCTCPSource)
+	sc.RegisterCTCP("USERINFO", defaultCTCPUserInfo)
+}
+
+// handleCTCPMessage intercepts PRIVMSG/NOTICE whose trailing parameter is a
+// CTCP message and dispatches it to the registered handler, if any.
+func (sc *ServerConnection) handleCTCPMessage(info eventmgr.InfoMap) {
+	command, _ := info["command"].(string)
+	params, _ := info["params"].([]string)
+	prefix, _ := info["prefix"].(string)
+	if len(params) < 2 {
+		return
+	}
+
+	ctcpCommand, args, ok := ctcp.Parse(params[len(params)-1])
+	if !ok {
+		return
+	}
+
+	handler, ok := sc.ctcpHandlers[ctcpCommand]
+	if !ok {
+		return
+	}
+
+	nick, user, host := splitPrefix(prefix)
+	handler(sc, CTCPEvent{
+		Command: ctcpCommand,
+		Args:    args,
+		Nick:    nick,
+		User:    user,
+		Host:    host,
+		Target:  params[0],
+		Reply:   strings.EqualFold(command, "NOTICE"),
+	})
+}
+
+// replyCTCP sends a CTCP reply to target as a NOTICE, per the CTCP spec,
+// subject to per-target flood protection.
+func (sc *ServerConnection) replyCTCP(target, command, args string) {
+	if !sc.allowCTCPReply(target) {
+		return
+	}
+	sc.Send(nil, "", "NOTICE", target, ctcp.Wrap(command, args))
+}
+
+func (sc *ServerConnection) allowCTCPReply(target string) bool {
+	if sc.ctcpLimiter == nil {
+		sc.ctcpLimiter = make(map[string]time.Time)
+	}
+
+	key := sc.Features.CaseFold(target)
+	now := time.Now()
+	if last, ok := sc.ctcpLimiter[key]; ok && now.Sub(last) < ctcpReplyInterval {
+		return false
+	}
+
+	sc.ctcpLimiter[key] = now
+	return true
+}
+
+func defaultCTCPPing(sc *ServerConnection, ev CTCPEvent) {
+	if !sc.CTCPDefaults || ev.Reply {
+		return
+	}
+	sc.replyCTCP(ev.Nick, "PING", ev.Args)
+}
+
+func defaultCTCPVersion(sc *ServerConnection, ev CTCPEvent) {
+	if !sc.CTCPDefaults || ev.Reply {
+		return
+	}
+	sc.replyCTCP(ev.Nick, "VERSION", sc.Version)
+}
+
+func defaultCTCPTime(sc *ServerConnection, ev CTCPEvent) {
+	if !sc.CTCPDefaults || ev.Reply {
+		return
+	}
+	sc.replyCTCP(ev.Nick, "TIME", time.Now().Format(time.RFC1123))
+}
+
+func defaultCTCPClientInfo(sc *ServerConnection, ev CTCPEvent) {
+	if !sc.CTCPDefaults || ev.Reply {
+		return
+	}
+
+	names := make([]string, 0, len(sc.ctcpHandlers))
+	for name := range sc.ctcpHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sc.replyCTCP(ev.Nick, "CLIENTINFO", strings.Join(names, " "))
+}
+
+func defaultCTCPSource(sc *ServerConnection, ev CTCPEvent) {
+	if !sc.CTCPDefaults || ev.Reply {
+		return
+	}
+	sc.replyCTCP(ev.Nick, "SOURCE", "https://github.com/DanielOaks/girc-go")
+}
+
+func defaultCTCPUserInfo(sc *ServerConnection, ev CTCPEvent) {
+	if !sc.CTCPDefaults || ev.Reply {
+		return
+	}
+	sc.replyCTCP(ev.Nick, "USERINFO", sc.InitialRealName)
+}
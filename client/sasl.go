@@ -0,0 +1,354 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package gircclient
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/DanielOaks/girc-go/eventmgr"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// maxAuthenticateChunk is the maximum number of base64 bytes sent per
+// AUTHENTICATE line, per the sasl IRCv3 spec.
+const maxAuthenticateChunk = 400
+
+// saslResult is delivered on saslChan once SASL negotiation settles, either
+// way.
+type saslResult struct {
+	err error
+}
+
+// wantsSASL reports whether SASL should be attempted at all. SASLLogin is
+// the usual trigger, but SASL EXTERNAL's authzid is conventionally left
+// empty (the server derives identity from the client certificate), so
+// SASLMech="EXTERNAL" opts in even with SASLLogin unset.
+func (sc *ServerConnection) wantsSASL() bool {
+	return sc.SASLLogin != "" || strings.EqualFold(sc.SASLMech, "EXTERNAL")
+}
+
+// startSASL begins SASL authentication once the "sasl" capability has been
+// acked. CAP END is held back by maybeFinishCapNegotiation until it settles.
+func (sc *ServerConnection) startSASL() {
+	mech := strings.ToUpper(sc.SASLMech)
+	if mech == "" {
+		mech = "PLAIN"
+	}
+
+	sc.saslInProgress = true
+	sc.saslMechInUse = mech
+	sc.saslChan = make(chan saslResult, 1)
+	sc.scram = nil
+
+	sc.Send(nil, "", "AUTHENTICATE", mech)
+}
+
+// handleAuthenticate advances the SASL state machine in response to an
+// AUTHENTICATE line from the server.
+func (sc *ServerConnection) handleAuthenticate(info eventmgr.InfoMap) {
+	if !sc.saslInProgress {
+		return
+	}
+
+	params, _ := info["params"].([]string)
+	var payload string
+	if len(params) > 0 {
+		payload = params[0]
+	}
+
+	var challenge []byte
+	if payload != "+" {
+		decoded, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			sc.finishSASL(fmt.Errorf("malformed SASL challenge: %w", err))
+			return
+		}
+		challenge = decoded
+	}
+
+	response, done, err := sc.nextSASLResponse(challenge)
+	if err != nil {
+		sc.finishSASL(err)
+		return
+	}
+	if done {
+		return
+	}
+
+	sc.sendSASLResponse(response)
+}
+
+// nextSASLResponse advances the mechanism in use given the (already
+// base64-decoded) server challenge, returning the client's next response.
+// done is true once the mechanism has nothing left to send and is just
+// waiting on the final numeric.
+func (sc *ServerConnection) nextSASLResponse(challenge []byte) (response []byte, done bool, err error) {
+	switch sc.saslMechInUse {
+	case "PLAIN":
+		response, err = sc.saslPlainResponse()
+		return response, false, err
+
+	case "EXTERNAL":
+		response, err = sc.saslExternalResponse()
+		return response, false, err
+
+	case "SCRAM-SHA-256":
+		if sc.scram == nil {
+			sc.scram = newSCRAMClient()
+		}
+		switch sc.scram.step {
+		case 0:
+			response, err = sc.scram.clientFirst(sc.SASLLogin)
+			return response, false, err
+		case 1:
+			response, err = sc.scram.clientFinal(string(challenge), sc.SASLPassword)
+			return response, false, err
+		case 2:
+			if err = sc.scram.verifyServerFinal(string(challenge)); err != nil {
+				return nil, true, err
+			}
+			// The exchange is cryptographically done, but the server still
+			// expects a final AUTHENTICATE before it emits 903 (e.g.
+			// Atheme-based services); send an empty response rather than
+			// short-circuiting with done=true.
+			return []byte{}, false, nil
+		default:
+			return nil, true, nil
+		}
+
+	default:
+		return nil, false, fmt.Errorf("unsupported SASL mechanism %q", sc.saslMechInUse)
+	}
+}
+
+// saslPlainResponse builds the SASL PLAIN payload: authzid\0authcid\0password.
+func (sc *ServerConnection) saslPlainResponse() ([]byte, error) {
+	if sc.SASLLogin == "" || sc.SASLPassword == "" {
+		return nil, errors.New("SASLLogin and SASLPassword must be set for SASL PLAIN")
+	}
+	return []byte("\x00" + sc.SASLLogin + "\x00" + sc.SASLPassword), nil
+}
+
+// saslExternalResponse builds the SASL EXTERNAL payload, relying on the TLS
+// client certificate passed to Connect for the actual authentication; the
+// payload itself is just the (often empty) authzid.
+func (sc *ServerConnection) saslExternalResponse() ([]byte, error) {
+	if sc.tlsconfig == nil || len(sc.tlsconfig.Certificates) == 0 {
+		return nil, errors.New("SASL EXTERNAL requires a TLS client certificate")
+	}
+	return []byte(sc.SASLLogin), nil
+}
+
+// sendSASLResponse base64-encodes payload and sends it as one or more
+// AUTHENTICATE lines, each at most maxAuthenticateChunk bytes, terminated by
+// an empty "+" line when the encoded payload is empty or an exact multiple
+// of the chunk size.
+func (sc *ServerConnection) sendSASLResponse(payload []byte) {
+	encoded := base64.StdEncoding.EncodeToString(payload)
+
+	if encoded == "" {
+		sc.Send(nil, "", "AUTHENTICATE", "+")
+		return
+	}
+
+	for len(encoded) > 0 {
+		n := len(encoded)
+		if n > maxAuthenticateChunk {
+			n = maxAuthenticateChunk
+		}
+		sc.Send(nil, "", "AUTHENTICATE", encoded[:n])
+		encoded = encoded[n:]
+		if n < maxAuthenticateChunk {
+			return
+		}
+	}
+
+	// encoded payload was an exact multiple of the chunk size; tell the
+	// server there's no more coming
+	sc.Send(nil, "", "AUTHENTICATE", "+")
+}
+
+// handleSASLNumeric handles the terminal SASL numerics (900, 903-907).
+func (sc *ServerConnection) handleSASLNumeric(info eventmgr.InfoMap) {
+	command, _ := info["command"].(string)
+
+	switch command {
+	case "903":
+		sc.finishSASL(nil)
+	case "900":
+		// RPL_LOGGEDIN is informational; SASL isn't done until 903/904
+	case "904", "905", "906", "907":
+		params, _ := info["params"].([]string)
+		reason := ""
+		if len(params) > 0 {
+			reason = params[len(params)-1]
+		}
+		sc.finishSASL(fmt.Errorf("SASL authentication failed (%s): %s", command, reason))
+	}
+}
+
+// finishSASL settles SASL negotiation, delivering the result on saslChan,
+// disconnecting if SASL was mandatory and failed, and letting capability
+// negotiation proceed to CAP END otherwise.
+func (sc *ServerConnection) finishSASL(err error) {
+	sc.saslInProgress = false
+	sc.scram = nil
+
+	select {
+	case sc.saslChan <- saslResult{err: err}:
+	default:
+	}
+
+	if err != nil && sc.wantsSASL() {
+		sc.Shutdown("SASL authentication failed: " + err.Error())
+		return
+	}
+
+	sc.maybeFinishCapNegotiation()
+}
+
+// gs2Header is the GS2 channel-binding header we send: "n" means we don't
+// support channel binding.
+const gs2Header = "n,,"
+
+// scramClient drives one attempt at RFC 5802's SCRAM-SHA-256 exchange.
+type scramClient struct {
+	step      int // 0: haven't sent client-first; 1: awaiting server-first; 2: awaiting server-final
+	nonce     string
+	firstBare string
+	authMsg   string
+	serverSig []byte
+}
+
+func newSCRAMClient() *scramClient {
+	return &scramClient{nonce: scramNonce()}
+}
+
+// clientFirst builds the GS2 header plus client-first-message-bare.
+func (c *scramClient) clientFirst(authcid string) ([]byte, error) {
+	c.firstBare = "n=" + scramEscape(authcid) + ",r=" + c.nonce
+	c.step = 1
+	return []byte(gs2Header + c.firstBare), nil
+}
+
+// clientFinal parses the server-first-message, derives the keys per RFC
+// 5802, and builds client-final-message including the proof.
+func (c *scramClient) clientFinal(serverFirst, password string) ([]byte, error) {
+	fields, err := parseSCRAMFields(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+
+	serverNonce := fields["r"]
+	if !strings.HasPrefix(serverNonce, c.nonce) {
+		return nil, errors.New("SASL SCRAM-SHA-256: server nonce does not extend client nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(fields["s"])
+	if err != nil {
+		return nil, fmt.Errorf("SASL SCRAM-SHA-256: invalid salt: %w", err)
+	}
+
+	iterations, err := strconv.Atoi(fields["i"])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("SASL SCRAM-SHA-256: invalid iteration count")
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	channelBinding := base64.StdEncoding.EncodeToString([]byte(gs2Header))
+	clientFinalWithoutProof := "c=" + channelBinding + ",r=" + serverNonce
+
+	c.authMsg = c.firstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	clientSignature := hmacSHA256(storedKey[:], []byte(c.authMsg))
+	clientProof := xorBytes(clientKey, clientSignature)
+
+	serverKey := hmacSHA256(saltedPassword, []byte("Server Key"))
+	c.serverSig = hmacSHA256(serverKey, []byte(c.authMsg))
+
+	c.step = 2
+
+	finalMsg := clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientProof)
+	return []byte(finalMsg), nil
+}
+
+// verifyServerFinal checks the server's signature in server-final-message
+// against the one we derived in clientFinal.
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+	fields, err := parseSCRAMFields(serverFinal)
+	if err != nil {
+		return err
+	}
+
+	if reason, ok := fields["e"]; ok {
+		return fmt.Errorf("SASL SCRAM-SHA-256: server reported error: %s", reason)
+	}
+
+	got, err := base64.StdEncoding.DecodeString(fields["v"])
+	if err != nil {
+		return fmt.Errorf("SASL SCRAM-SHA-256: invalid server signature: %w", err)
+	}
+
+	if !hmac.Equal(got, c.serverSig) {
+		return errors.New("SASL SCRAM-SHA-256: server signature verification failed")
+	}
+
+	c.step = 3
+	return nil
+}
+
+// scramNonce returns a fresh random client nonce.
+func scramNonce() string {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		panic("gircclient: failed to read random bytes: " + err.Error())
+	}
+	return base64.RawStdEncoding.EncodeToString(buf)
+}
+
+// scramEscape escapes '=' and ',' per RFC 5802 section 5.1.
+func scramEscape(s string) string {
+	s = strings.ReplaceAll(s, "=", "=3D")
+	s = strings.ReplaceAll(s, ",", "=2C")
+	return s
+}
+
+// parseSCRAMFields splits a comma-separated "key=value" SCRAM message into
+// a map.
+func parseSCRAMFields(msg string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed SCRAM message field %q", part)
+		}
+		fields[kv[0]] = kv[1]
+	}
+	return fields, nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
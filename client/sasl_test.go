@@ -0,0 +1,129 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package gircclient
+
+import "testing"
+
+// The vector below is the worked SCRAM-SHA-256 example from RFC 7677
+// section 3, for user "user" with password "pencil".
+const (
+	scramTestClientNonce = "rOprNGfwEbeRWgbNEkqO"
+	scramTestClientFirst = "n=user,r=" + scramTestClientNonce
+	scramTestServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	scramTestClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	scramTestServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+	scramTestPassword    = "pencil"
+)
+
+func TestSCRAMClientFirst(t *testing.T) {
+	c := &scramClient{nonce: scramTestClientNonce}
+
+	got, err := c.clientFirst("user")
+	if err != nil {
+		t.Fatalf("clientFirst: unexpected error: %v", err)
+	}
+	if want := gs2Header + scramTestClientFirst; string(got) != want {
+		t.Errorf("clientFirst = %q, want %q", got, want)
+	}
+	if c.step != 1 {
+		t.Errorf("step after clientFirst = %d, want 1", c.step)
+	}
+}
+
+func TestSCRAMClientFinal(t *testing.T) {
+	c := &scramClient{nonce: scramTestClientNonce, firstBare: scramTestClientFirst, step: 1}
+
+	got, err := c.clientFinal(scramTestServerFirst, scramTestPassword)
+	if err != nil {
+		t.Fatalf("clientFinal: unexpected error: %v", err)
+	}
+	if string(got) != scramTestClientFinal {
+		t.Errorf("clientFinal = %q, want %q", got, scramTestClientFinal)
+	}
+	if c.step != 2 {
+		t.Errorf("step after clientFinal = %d, want 2", c.step)
+	}
+
+	if err := c.verifyServerFinal(scramTestServerFinal); err != nil {
+		t.Errorf("verifyServerFinal: %v", err)
+	}
+	if c.step != 3 {
+		t.Errorf("step after verifyServerFinal = %d, want 3", c.step)
+	}
+}
+
+func TestSCRAMClientFinalRejectsShortServerNonce(t *testing.T) {
+	c := &scramClient{nonce: scramTestClientNonce, firstBare: scramTestClientFirst, step: 1}
+
+	_, err := c.clientFinal("r=not-our-nonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", scramTestPassword)
+	if err == nil {
+		t.Fatal("clientFinal: expected error for a server nonce that doesn't extend ours, got nil")
+	}
+}
+
+func TestSCRAMVerifyServerFinalRejectsBadSignature(t *testing.T) {
+	c := &scramClient{nonce: scramTestClientNonce, firstBare: scramTestClientFirst, step: 1}
+	if _, err := c.clientFinal(scramTestServerFirst, scramTestPassword); err != nil {
+		t.Fatalf("clientFinal: unexpected error: %v", err)
+	}
+
+	if err := c.verifyServerFinal("v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); err == nil {
+		t.Fatal("verifyServerFinal: expected error for a mismatched server signature, got nil")
+	}
+}
+
+func TestSCRAMVerifyServerFinalReportsServerError(t *testing.T) {
+	c := &scramClient{}
+
+	err := c.verifyServerFinal("e=other-error")
+	if err == nil {
+		t.Fatal("verifyServerFinal: expected error when server reports e=, got nil")
+	}
+}
+
+func TestSCRAMStepTwoSendsEmptyFinalResponse(t *testing.T) {
+	sc := &ServerConnection{}
+	c := &scramClient{nonce: scramTestClientNonce, firstBare: scramTestClientFirst, step: 1}
+	if _, err := c.clientFinal(scramTestServerFirst, scramTestPassword); err != nil {
+		t.Fatalf("clientFinal: unexpected error: %v", err)
+	}
+	sc.scram = c
+	sc.saslMechInUse = "SCRAM-SHA-256"
+
+	response, done, err := sc.nextSASLResponse([]byte(scramTestServerFinal))
+	if err != nil {
+		t.Fatalf("nextSASLResponse: unexpected error: %v", err)
+	}
+	if done {
+		t.Fatal("nextSASLResponse: done = true, want false so the client sends a final AUTHENTICATE +")
+	}
+	if len(response) != 0 {
+		t.Errorf("response = %q, want empty (the client has nothing left to prove, but must still answer)", response)
+	}
+}
+
+func TestWantsSASL(t *testing.T) {
+	tests := []struct {
+		name  string
+		login string
+		mech  string
+		want  bool
+	}{
+		{"no login, no mech", "", "", false},
+		{"login set", "alice", "", true},
+		{"PLAIN with no login", "", "PLAIN", false},
+		{"EXTERNAL with no login", "", "EXTERNAL", true},
+		{"EXTERNAL case-insensitive", "", "external", true},
+		{"EXTERNAL with login too", "alice", "EXTERNAL", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &ServerConnection{SASLLogin: tt.login, SASLMech: tt.mech}
+			if got := sc.wantsSASL(); got != tt.want {
+				t.Errorf("wantsSASL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package gircclient
+
+import (
+	"strings"
+	"time"
+
+	"github.com/DanielOaks/girc-go/eventmgr"
+	"github.com/DanielOaks/girc-go/ircmsg"
+)
+
+// writerLoop is the dedicated goroutine that actually writes queued lines to
+// the socket, spacing them out according to SendRate/Burst. It drains
+// anything left in pwrite before returning, so a final QUIT queued right
+// before Shutdown closes end still gets written.
+func (sc *ServerConnection) writerLoop(pwrite chan []byte, end chan struct{}) {
+	defer sc.wg.Done()
+
+	limiter := newRateLimiter(sc.SendRate, sc.Burst)
+
+	for {
+		select {
+		case line := <-pwrite:
+			sc.writeLine(limiter, end, line)
+		case <-end:
+			for {
+				select {
+				case line := <-pwrite:
+					sc.writeLine(limiter, end, line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeLine waits for the rate limiter to admit a send, writes the line to
+// the socket, and dispatches the raw-out event for it.
+func (sc *ServerConnection) writeLine(limiter *rateLimiter, end chan struct{}, line []byte) {
+	limiter.wait(end)
+
+	if _, err := sc.connection.Write(line); err != nil {
+		return
+	}
+
+	info := eventmgr.NewInfoMap()
+	info["server"] = sc
+	info["direction"] = "out"
+	info["data"] = strings.TrimRight(string(line), "\r\n")
+	sc.dispatchRawOut(info)
+}
+
+// effectiveMaxLineLen returns the line length budget that outgoing messages
+// are truncated to: the server-advertised ISUPPORT LINELEN, if any,
+// otherwise MaxLineLen.
+func (sc *ServerConnection) effectiveMaxLineLen() int {
+	if n := sc.Features.LineLen(); n > 0 {
+		return n
+	}
+	return sc.MaxLineLen
+}
+
+// truncateLine truncates the trailing parameter of msg, if necessary, so
+// that it serializes to at most maxLen bytes, not counting any leading
+// message tags.
+func truncateLine(msg *ircmsg.IRCMessage, maxLen int) {
+	if maxLen <= 0 || len(msg.Params) == 0 {
+		return
+	}
+
+	untagged := *msg
+	untagged.Tags = nil
+
+	line, err := untagged.Line()
+	if err != nil {
+		return
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	overflow := len(line) - maxLen
+	if overflow <= 0 {
+		return
+	}
+
+	last := len(msg.Params) - 1
+	trailing := msg.Params[last]
+	if overflow >= len(trailing) {
+		msg.Params[last] = ""
+		return
+	}
+
+	msg.Params[last] = trailing[:len(trailing)-overflow]
+}
+
+// rateLimiter is a simple token bucket used to flood-protect outgoing
+// messages: up to `max` messages may be sent immediately, after which sends
+// are spaced `rate` apart.
+type rateLimiter struct {
+	rate   time.Duration
+	max    int
+	tokens int
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter allowing `burst` immediate sends and
+// `rate` between sends thereafter. A non-positive rate disables limiting.
+func newRateLimiter(rate time.Duration, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, max: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks, if necessary, until a token is available to send, or end is
+// closed.
+func (rl *rateLimiter) wait(end chan struct{}) {
+	if rl.rate <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if refill := int(now.Sub(rl.last) / rl.rate); refill > 0 {
+		rl.tokens += refill
+		if rl.tokens > rl.max {
+			rl.tokens = rl.max
+		}
+		rl.last = now
+	}
+
+	if rl.tokens > 0 {
+		rl.tokens--
+		return
+	}
+
+	timer := time.NewTimer(rl.rate)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-end:
+	}
+	rl.last = time.Now()
+}
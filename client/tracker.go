@@ -0,0 +1,259 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package gircclient
+
+import (
+	"strings"
+
+	"github.com/DanielOaks/girc-go/eventmgr"
+	"github.com/DanielOaks/girc-go/tracker"
+)
+
+// Channels returns every channel currently joined, in no particular order.
+func (sc *ServerConnection) Channels() []*tracker.Channel {
+	return sc.tracker.Channels()
+}
+
+// Channel returns the tracked channel with the given name, or nil if it's
+// not currently joined.
+func (sc *ServerConnection) Channel(name string) *tracker.Channel {
+	return sc.tracker.Channel(name)
+}
+
+// registerTrackerEvents wires up the handlers that feed the channel/user
+// tracker. Called once from newServerConnection.
+func (sc *ServerConnection) registerTrackerEvents() {
+	sc.tracker.CaseFold = sc.Features.CaseFold
+	sc.tracker.PrefixModes = sc.Features.Prefix
+
+	sc.RegisterEvent("in", "JOIN", sc.handleJoin, 0)
+	sc.RegisterEvent("in", "PART", sc.handlePart, 0)
+	sc.RegisterEvent("in", "QUIT", sc.handleQuit, 0)
+	sc.RegisterEvent("in", "KICK", sc.handleKick, 0)
+	sc.RegisterEvent("in", "NICK", sc.handleNick, 0)
+	sc.RegisterEvent("in", "MODE", sc.handleMode, 0)
+	sc.RegisterEvent("in", "TOPIC", sc.handleTopic, 0)
+	sc.RegisterEvent("in", "AWAY", sc.handleAway, 0)
+	sc.RegisterEvent("in", "ACCOUNT", sc.handleAccount, 0)
+	sc.RegisterEvent("in", "CHGHOST", sc.handleChgHost, 0)
+	sc.RegisterEvent("in", "353", sc.handleNamesReply, 0)
+	sc.RegisterEvent("in", "366", sc.handleNamesEnd, 0)
+	sc.RegisterEvent("in", "332", sc.handleTopicReply, 0)
+}
+
+func (sc *ServerConnection) handleJoin(info eventmgr.InfoMap) {
+	prefix, _ := info["prefix"].(string)
+	params, _ := info["params"].([]string)
+	if len(params) < 1 {
+		return
+	}
+
+	nick, user, host := splitPrefix(prefix)
+
+	// with extended-join, params[1] is the account ("*" if logged out) and
+	// params[2] the realname
+	account := ""
+	if len(params) >= 2 {
+		account = params[1]
+	}
+
+	channel, chanUser := sc.tracker.Join(params[0], nick, user, host, account)
+	sc.dispatchTrackerEvent("channel-join", channel, chanUser)
+}
+
+func (sc *ServerConnection) handlePart(info eventmgr.InfoMap) {
+	prefix, _ := info["prefix"].(string)
+	params, _ := info["params"].([]string)
+	if len(params) < 1 {
+		return
+	}
+
+	nick, _, _ := splitPrefix(prefix)
+	channel, chanUser := sc.tracker.Part(params[0], nick)
+	if channel == nil {
+		return
+	}
+	sc.dispatchTrackerEvent("channel-part", channel, chanUser)
+}
+
+func (sc *ServerConnection) handleKick(info eventmgr.InfoMap) {
+	params, _ := info["params"].([]string)
+	if len(params) < 2 {
+		return
+	}
+
+	channel, chanUser := sc.tracker.Kick(params[0], params[1])
+	if channel == nil {
+		return
+	}
+	sc.dispatchTrackerEvent("channel-part", channel, chanUser)
+}
+
+func (sc *ServerConnection) handleQuit(info eventmgr.InfoMap) {
+	prefix, _ := info["prefix"].(string)
+	nick, _, _ := splitPrefix(prefix)
+
+	for _, entry := range sc.tracker.Quit(nick) {
+		sc.dispatchTrackerEvent("user-quit", entry.Channel, entry.User)
+	}
+}
+
+func (sc *ServerConnection) handleNick(info eventmgr.InfoMap) {
+	prefix, _ := info["prefix"].(string)
+	params, _ := info["params"].([]string)
+	if len(params) < 1 {
+		return
+	}
+
+	oldNick, _, _ := splitPrefix(prefix)
+	sc.tracker.Nick(oldNick, params[0])
+}
+
+func (sc *ServerConnection) handleMode(info eventmgr.InfoMap) {
+	params, _ := info["params"].([]string)
+	if len(params) < 2 {
+		return
+	}
+
+	target := params[0]
+	if !sc.isChannelName(target) {
+		return
+	}
+
+	prefixModes, _ := sc.Features.Prefix()
+	classA, classB, classC, _ := sc.Features.ChanModes()
+	args := params[2:]
+	argIndex := 0
+	add := true
+
+	takesArg := func(mode rune, adding bool) bool {
+		switch {
+		case strings.ContainsRune(prefixModes, mode):
+			return true
+		case strings.ContainsRune(classA, mode), strings.ContainsRune(classB, mode):
+			return true
+		case strings.ContainsRune(classC, mode):
+			return adding
+		default:
+			return false
+		}
+	}
+
+	for _, r := range params[1] {
+		switch r {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+
+		var arg string
+		if takesArg(r, add) && argIndex < len(args) {
+			arg = args[argIndex]
+			argIndex++
+		}
+
+		if arg == "" || !strings.ContainsRune(prefixModes, r) {
+			continue
+		}
+
+		if u := sc.tracker.Mode(target, add, byte(r), arg); u != nil {
+			sc.dispatchTrackerEvent("channel-mode-change", sc.tracker.Channel(target), u)
+		}
+	}
+}
+
+func (sc *ServerConnection) handleTopic(info eventmgr.InfoMap) {
+	params, _ := info["params"].([]string)
+	if len(params) < 2 {
+		return
+	}
+
+	channel := sc.tracker.Topic(params[0], params[1])
+	sc.dispatchTrackerEvent("topic-change", channel, nil)
+}
+
+// handleTopicReply handles 332 RPL_TOPIC, sent in response to JOIN.
+func (sc *ServerConnection) handleTopicReply(info eventmgr.InfoMap) {
+	params, _ := info["params"].([]string)
+	if len(params) < 3 {
+		return
+	}
+
+	channel := sc.tracker.Topic(params[1], params[2])
+	sc.dispatchTrackerEvent("topic-change", channel, nil)
+}
+
+// handleNamesReply handles 353 RPL_NAMREPLY: "<nick> <=|*|@> <channel> :<names>".
+func (sc *ServerConnection) handleNamesReply(info eventmgr.InfoMap) {
+	params, _ := info["params"].([]string)
+	if len(params) < 4 {
+		return
+	}
+
+	sc.tracker.Names(params[2], strings.Fields(params[3]))
+}
+
+// handleNamesEnd handles 366 RPL_ENDOFNAMES. There's nothing left to do by
+// this point, since Names applies members incrementally as 353 lines
+// arrive, but we still consume it to document that it's accounted for.
+func (sc *ServerConnection) handleNamesEnd(info eventmgr.InfoMap) {
+}
+
+func (sc *ServerConnection) handleAway(info eventmgr.InfoMap) {
+	prefix, _ := info["prefix"].(string)
+	params, _ := info["params"].([]string)
+	nick, _, _ := splitPrefix(prefix)
+	sc.tracker.Away(nick, len(params) > 0)
+}
+
+func (sc *ServerConnection) handleAccount(info eventmgr.InfoMap) {
+	prefix, _ := info["prefix"].(string)
+	params, _ := info["params"].([]string)
+	if len(params) < 1 {
+		return
+	}
+
+	nick, _, _ := splitPrefix(prefix)
+	sc.tracker.Account(nick, params[0])
+}
+
+func (sc *ServerConnection) handleChgHost(info eventmgr.InfoMap) {
+	prefix, _ := info["prefix"].(string)
+	params, _ := info["params"].([]string)
+	if len(params) < 2 {
+		return
+	}
+
+	nick, _, _ := splitPrefix(prefix)
+	sc.tracker.ChgHost(nick, params[0], params[1])
+}
+
+func (sc *ServerConnection) isChannelName(name string) bool {
+	return len(name) > 0 && strings.ContainsRune(sc.Features.ChanTypes(), rune(name[0]))
+}
+
+func (sc *ServerConnection) dispatchTrackerEvent(name string, channel *tracker.Channel, user *tracker.ChannelUser) {
+	info := eventmgr.NewInfoMap()
+	info["server"] = sc
+	info["channel"] = channel
+	if user != nil {
+		info["user"] = user
+	}
+	sc.dispatchIn(name, info)
+}
+
+// splitPrefix splits an IRC message prefix ("nick!user@host") into its
+// parts; prefixes without a user/host (e.g. a server name) return the whole
+// string as nick.
+func splitPrefix(prefix string) (nick, user, host string) {
+	bang := strings.IndexByte(prefix, '!')
+	at := strings.IndexByte(prefix, '@')
+	if bang < 0 || at < 0 || bang > at {
+		return prefix, "", ""
+	}
+	return prefix[:bang], prefix[bang+1 : at], prefix[at+1:]
+}
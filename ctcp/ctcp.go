@@ -0,0 +1,33 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+// Package ctcp implements the wire format for Client-To-Client Protocol
+// messages, which ride inside PRIVMSG/NOTICE trailing parameters wrapped in
+// \x01...\x01.
+package ctcp
+
+import "strings"
+
+const delim = '\x01'
+
+// Parse extracts the command and argument from a PRIVMSG/NOTICE trailing
+// parameter. ok is false if trailing isn't a well-formed CTCP message.
+func Parse(trailing string) (command, args string, ok bool) {
+	if len(trailing) < 2 || trailing[0] != delim || trailing[len(trailing)-1] != delim {
+		return "", "", false
+	}
+
+	inner := trailing[1 : len(trailing)-1]
+	command, args, _ = strings.Cut(inner, " ")
+	return strings.ToUpper(command), args, true
+}
+
+// Wrap formats command and args as a CTCP message suitable for a PRIVMSG or
+// NOTICE trailing parameter.
+func Wrap(command, args string) string {
+	msg := command
+	if args != "" {
+		msg += " " + args
+	}
+	return string(delim) + msg + string(delim)
+}
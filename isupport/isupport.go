@@ -0,0 +1,224 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+// Package isupport parses RPL_ISUPPORT (005) tokens into typed server
+// feature information.
+package isupport
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ServerFeatures holds the server's advertised ISUPPORT (005) tokens,
+// updated incrementally as each numeric arrives. The zero value is ready to
+// use.
+type ServerFeatures struct {
+	raw map[string]string
+}
+
+// Apply parses one 005 numeric's tokens (KEY, KEY=value, or -KEY to negate
+// a previously-seen KEY) and merges them in.
+func (fs *ServerFeatures) Apply(tokens []string) {
+	if fs.raw == nil {
+		fs.raw = make(map[string]string)
+	}
+
+	for _, tok := range tokens {
+		if strings.HasPrefix(tok, "-") {
+			delete(fs.raw, strings.ToUpper(tok[1:]))
+			continue
+		}
+
+		key := tok
+		value := ""
+		if i := strings.IndexByte(tok, '='); i >= 0 {
+			key = tok[:i]
+			value = tok[i+1:]
+		}
+		fs.raw[strings.ToUpper(key)] = value
+	}
+}
+
+// Has reports whether name was advertised (with or without a value).
+func (fs *ServerFeatures) Has(name string) bool {
+	_, ok := fs.raw[strings.ToUpper(name)]
+	return ok
+}
+
+// Get returns the raw value for name and whether it was advertised at all.
+func (fs *ServerFeatures) Get(name string) (string, bool) {
+	v, ok := fs.raw[strings.ToUpper(name)]
+	return v, ok
+}
+
+func (fs *ServerFeatures) intOr(name string, def int) int {
+	v, ok := fs.raw[name]
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// CaseMapping returns the negotiated CASEMAPPING, defaulting to "rfc1459"
+// per RFC 1459 servers that don't advertise one.
+func (fs *ServerFeatures) CaseMapping() string {
+	if v, ok := fs.raw["CASEMAPPING"]; ok && v != "" {
+		return v
+	}
+	return "rfc1459"
+}
+
+// ChanTypes returns the set of channel-name prefix characters, defaulting
+// to "#".
+func (fs *ServerFeatures) ChanTypes() string {
+	if v, ok := fs.raw["CHANTYPES"]; ok {
+		return v
+	}
+	return "#"
+}
+
+// ChanModes returns the four comma-separated mode-letter classes (A, B, C,
+// D) from ISUPPORT CHANMODES: A always takes a parameter, B always takes a
+// parameter, C takes a parameter only when being set, and D never does.
+func (fs *ServerFeatures) ChanModes() (a, b, c, d string) {
+	parts := strings.SplitN(fs.raw["CHANMODES"], ",", 4)
+	for len(parts) < 4 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1], parts[2], parts[3]
+}
+
+// Prefix returns the parallel mode-letters and sigils from ISUPPORT PREFIX
+// (e.g. "(ov)@+" -> "ov", "@+"), in descending rank order. It defaults to
+// the RFC 2812 op/voice prefixes if the server doesn't advertise one.
+func (fs *ServerFeatures) Prefix() (modes, sigils string) {
+	v, ok := fs.raw["PREFIX"]
+	if !ok || len(v) == 0 || v[0] != '(' {
+		return "ov", "@+"
+	}
+
+	end := strings.IndexByte(v, ')')
+	if end < 0 {
+		return "ov", "@+"
+	}
+	return v[1:end], v[end+1:]
+}
+
+// Network returns the NETWORK name, or "" if not advertised.
+func (fs *ServerFeatures) Network() string { return fs.raw["NETWORK"] }
+
+// NickLen returns the maximum nickname length, defaulting to the RFC 1459
+// minimum of 9.
+func (fs *ServerFeatures) NickLen() int { return fs.intOr("NICKLEN", 9) }
+
+// ChannelLen returns the maximum channel name length.
+func (fs *ServerFeatures) ChannelLen() int { return fs.intOr("CHANNELLEN", 200) }
+
+// TopicLen returns the maximum topic length, or 0 if unbounded/unknown.
+func (fs *ServerFeatures) TopicLen() int { return fs.intOr("TOPICLEN", 0) }
+
+// AwayLen returns the maximum AWAY message length, or 0 if unbounded/unknown.
+func (fs *ServerFeatures) AwayLen() int { return fs.intOr("AWAYLEN", 0) }
+
+// KickLen returns the maximum KICK reason length, or 0 if unbounded/unknown.
+func (fs *ServerFeatures) KickLen() int { return fs.intOr("KICKLEN", 0) }
+
+// Modes returns the maximum number of channel mode changes accepted per
+// MODE command.
+func (fs *ServerFeatures) Modes() int { return fs.intOr("MODES", 3) }
+
+// LineLen returns the server-advertised maximum line length, or 0 if not
+// advertised.
+func (fs *ServerFeatures) LineLen() int { return fs.intOr("LINELEN", 0) }
+
+// TargMax returns the per-command target limit advertised in the
+// comma-separated ISUPPORT TARGMAX list (e.g. "PRIVMSG:4,WHOIS:1"), or 0 if
+// command has no configured limit.
+func (fs *ServerFeatures) TargMax(command string) int {
+	v, ok := fs.raw["TARGMAX"]
+	if !ok {
+		return 0
+	}
+
+	for _, tok := range strings.Split(v, ",") {
+		kv := strings.SplitN(tok, ":", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], command) {
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
+
+// StatusMsg returns the STATUSMSG sigils that PRIVMSG/NOTICE may be
+// prefixed with to target only matching-or-above members of a channel.
+func (fs *ServerFeatures) StatusMsg() string { return fs.raw["STATUSMSG"] }
+
+// Elist returns the ELIST search extensions flags.
+func (fs *ServerFeatures) Elist() string { return fs.raw["ELIST"] }
+
+// MaxList returns the raw MAXLIST value (comma list of mode:limit pairs).
+func (fs *ServerFeatures) MaxList() string { return fs.raw["MAXLIST"] }
+
+// Monitor returns the maximum number of MONITOR targets, or 0 if MONITOR
+// isn't supported.
+func (fs *ServerFeatures) Monitor() int { return fs.intOr("MONITOR", 0) }
+
+// WhoX reports whether the server supports the WHOX extended WHO syntax.
+func (fs *ServerFeatures) WhoX() bool { return fs.Has("WHOX") }
+
+// UTF8Only reports whether the server requires UTF-8 everywhere.
+func (fs *ServerFeatures) UTF8Only() bool { return fs.Has("UTF8ONLY") }
+
+// CaseFold folds name according to the negotiated CASEMAPPING, so that
+// nicks and channel names can be compared for equality.
+func (fs *ServerFeatures) CaseFold(name string) string {
+	switch fs.CaseMapping() {
+	case "ascii":
+		return foldASCII(name)
+	case "rfc7613":
+		// approximation: proper rfc7613 casefolding needs a full Unicode
+		// PRECIS profile, which we don't depend on here.
+		return strings.ToLower(name)
+	default: // rfc1459, rfc1459-strict
+		return foldRFC1459(name)
+	}
+}
+
+func foldASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+// foldRFC1459 folds like foldASCII, additionally mapping {}|^ to their
+// lowercase counterparts []\~, per the traditional IRC casemapping.
+func foldRFC1459(s string) string {
+	b := []byte(foldASCII(s))
+	for i, c := range b {
+		switch c {
+		case '{':
+			b[i] = '['
+		case '}':
+			b[i] = ']'
+		case '|':
+			b[i] = '\\'
+		case '^':
+			b[i] = '~'
+		}
+	}
+	return string(b)
+}
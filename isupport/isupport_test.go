@@ -0,0 +1,117 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package isupport
+
+import "testing"
+
+func TestApplyAndGet(t *testing.T) {
+	var fs ServerFeatures
+	fs.Apply([]string{"NICKLEN=30", "CHANTYPES=#&", "AWAYNOTIFY"})
+
+	if !fs.Has("AWAYNOTIFY") {
+		t.Error(`Has("AWAYNOTIFY") = false, want true`)
+	}
+	if v, ok := fs.Get("nicklen"); !ok || v != "30" {
+		t.Errorf(`Get("nicklen") = %q, %v, want "30", true`, v, ok)
+	}
+	if fs.Has("MONITOR") {
+		t.Error(`Has("MONITOR") = true, want false (never advertised)`)
+	}
+}
+
+func TestApplyNegatesPreviousToken(t *testing.T) {
+	var fs ServerFeatures
+	fs.Apply([]string{"WHOX"})
+	fs.Apply([]string{"-WHOX"})
+
+	if fs.WhoX() {
+		t.Error("WhoX() = true after -WHOX negation, want false")
+	}
+}
+
+func TestCaseMappingDefault(t *testing.T) {
+	var fs ServerFeatures
+	if got := fs.CaseMapping(); got != "rfc1459" {
+		t.Errorf("CaseMapping() with nothing advertised = %q, want %q", got, "rfc1459")
+	}
+}
+
+func TestChanModes(t *testing.T) {
+	var fs ServerFeatures
+	fs.Apply([]string{"CHANMODES=eIbq,k,flj,CPST"})
+
+	a, b, c, d := fs.ChanModes()
+	if a != "eIbq" || b != "k" || c != "flj" || d != "CPST" {
+		t.Errorf("ChanModes() = %q, %q, %q, %q, want eIbq, k, flj, CPST", a, b, c, d)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		set        bool
+		wantModes  string
+		wantSigils string
+	}{
+		{"not advertised", "", false, "ov", "@+"},
+		{"standard", "(ov)@+", true, "ov", "@+"},
+		{"extended", "(qaohv)~&@%+", true, "qaohv", "~&@%+"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fs ServerFeatures
+			if tt.set {
+				fs.Apply([]string{"PREFIX=" + tt.value})
+			}
+
+			modes, sigils := fs.Prefix()
+			if modes != tt.wantModes || sigils != tt.wantSigils {
+				t.Errorf("Prefix() = %q, %q, want %q, %q", modes, sigils, tt.wantModes, tt.wantSigils)
+			}
+		})
+	}
+}
+
+func TestTargMax(t *testing.T) {
+	var fs ServerFeatures
+	fs.Apply([]string{"TARGMAX=PRIVMSG:4,WHOIS:1,NOTICE:"})
+
+	if got := fs.TargMax("privmsg"); got != 4 {
+		t.Errorf(`TargMax("privmsg") = %d, want 4`, got)
+	}
+	if got := fs.TargMax("KICK"); got != 0 {
+		t.Errorf(`TargMax("KICK") = %d, want 0 (no configured limit)`, got)
+	}
+	if got := fs.TargMax("NOTICE"); got != 0 {
+		t.Errorf(`TargMax("NOTICE") = %d, want 0 (empty limit means unbounded)`, got)
+	}
+}
+
+func TestCaseFold(t *testing.T) {
+	tests := []struct {
+		mapping string
+		input   string
+		want    string
+	}{
+		{"", "Foo[Bar]", "foo[bar]"},
+		{"ascii", "Foo{Bar}", "foo{bar}"},
+		{"rfc1459", "Foo{Bar}|^", "foo[bar]\\~"},
+		{"rfc1459-strict", "Foo{Bar}|^", "foo[bar]\\~"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mapping, func(t *testing.T) {
+			var fs ServerFeatures
+			if tt.mapping != "" {
+				fs.Apply([]string{"CASEMAPPING=" + tt.mapping})
+			}
+
+			if got := fs.CaseFold(tt.input); got != tt.want {
+				t.Errorf("CaseFold(%q) with CASEMAPPING=%q = %q, want %q", tt.input, tt.mapping, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+// Package tracker maintains an authoritative view of joined channels and
+// their members, built up from parsed JOIN/PART/QUIT/KICK/NICK/MODE/NAMES/
+// TOPIC traffic and related IRCv3 extensions.
+package tracker
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChannelUser is one member of a tracked Channel.
+type ChannelUser struct {
+	Nick     string
+	User     string
+	Host     string
+	Account  string // "" if unknown, "*" if known to be logged out
+	Away     bool
+	Modes    string // prefix-mode letters held in this channel, highest rank first
+	LastSeen time.Time
+}
+
+// HasMode reports whether the user holds the given prefix mode letter (e.g.
+// "o") in the channel.
+func (u *ChannelUser) HasMode(mode byte) bool {
+	return strings.IndexByte(u.Modes, mode) >= 0
+}
+
+// Channel is one channel the tracked connection has joined.
+//
+// Values returned from Tracker's exported methods (Channels, Channel) are
+// snapshots: copying the channel and its members out from under Tracker's
+// lock, so they're safe to read from any goroutine without further
+// synchronization, but won't reflect later changes.
+type Channel struct {
+	Name  string
+	Topic string
+
+	fold  func(string) string
+	users map[string]*ChannelUser
+}
+
+// Users returns the channel's members, in no particular order.
+func (c *Channel) Users() []*ChannelUser {
+	out := make([]*ChannelUser, 0, len(c.users))
+	for _, u := range c.users {
+		out = append(out, u)
+	}
+	return out
+}
+
+// User returns the member with the given nick, or nil if they're not in the
+// channel.
+func (c *Channel) User(nick string) *ChannelUser {
+	return c.users[c.fold(nick)]
+}
+
+// snapshot returns a copy of c, and of its members, safe to hand to a caller
+// outside Tracker's lock.
+func (c *Channel) snapshot() *Channel {
+	cp := &Channel{
+		Name:  c.Name,
+		Topic: c.Topic,
+		fold:  c.fold,
+		users: make(map[string]*ChannelUser, len(c.users)),
+	}
+	for key, u := range c.users {
+		uCopy := *u
+		cp.users[key] = &uCopy
+	}
+	return cp
+}
+
+// Tracker holds the state for every channel the connection has joined.
+//
+// CaseFold, if set, folds nicks/channel names per the network's negotiated
+// CASEMAPPING before they're used as map keys; it defaults to
+// strings.ToLower. PrefixModes, if set, returns the ISUPPORT PREFIX
+// mode-letters and sigils (e.g. "ov", "@+") in rank order, used to parse
+// NAMES prefixes and track prefix mode changes; it defaults to "ov"/"@+".
+//
+// A Tracker's methods are safe to call concurrently: the mutating methods
+// are normally driven by the connection's read loop while Channels/Channel
+// are exposed for callers to poll from their own goroutine.
+type Tracker struct {
+	CaseFold    func(string) string
+	PrefixModes func() (modes, sigils string)
+
+	mu       sync.RWMutex
+	channels map[string]*Channel
+}
+
+func (t *Tracker) fold(name string) string {
+	if t.CaseFold != nil {
+		return t.CaseFold(name)
+	}
+	return strings.ToLower(name)
+}
+
+func (t *Tracker) prefixes() (modes, sigils string) {
+	if t.PrefixModes != nil {
+		return t.PrefixModes()
+	}
+	return "ov", "@+"
+}
+
+func (t *Tracker) ensureChannels() {
+	if t.channels == nil {
+		t.channels = make(map[string]*Channel)
+	}
+}
+
+// Reset clears all tracked channel state, e.g. after a reconnect.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.channels = nil
+}
+
+// Channels returns every channel currently joined, in no particular order.
+func (t *Tracker) Channels() []*Channel {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make([]*Channel, 0, len(t.channels))
+	for _, c := range t.channels {
+		out = append(out, c.snapshot())
+	}
+	return out
+}
+
+// Channel returns the tracked channel with the given name, or nil if it's
+// not currently joined.
+func (t *Tracker) Channel(name string) *Channel {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c, ok := t.channels[t.fold(name)]
+	if !ok {
+		return nil
+	}
+	return c.snapshot()
+}
+
+// live returns the tracker's own *Channel for name, for internal mutation;
+// unlike Channel, it's not safe to hand to callers outside t.mu.
+func (t *Tracker) live(name string) *Channel {
+	return t.channels[t.fold(name)]
+}
+
+func (t *Tracker) channel(name string) *Channel {
+	t.ensureChannels()
+	key := t.fold(name)
+	c, ok := t.channels[key]
+	if !ok {
+		c = &Channel{Name: name, fold: t.fold, users: make(map[string]*ChannelUser)}
+		t.channels[key] = c
+	}
+	return c
+}
+
+// Join records nick joining channel (via JOIN, or an entry in a 353 NAMES
+// reply), stripping any leading prefix sigils from a multi-prefix NAMES
+// token. account is the extended-join/NAMES account name, "" if unknown.
+func (t *Tracker) Join(channelName, nick, user, host, account string) (*Channel, *ChannelUser) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	modes, sigils := t.prefixes()
+	prefixModes, nick := stripSigils(nick, modes, sigils)
+
+	c := t.channel(channelName)
+	u := &ChannelUser{Nick: nick, User: user, Host: host, Account: account, Modes: prefixModes, LastSeen: time.Now()}
+	c.users[t.fold(nick)] = u
+	return c, u
+}
+
+// stripSigils removes any leading PREFIX sigils (e.g. the "@+" of a
+// multi-prefix NAMES token) from nick, returning the corresponding mode
+// letters, highest rank first, and the sigil-free remainder.
+func stripSigils(nick, modes, sigils string) (prefixModes, rest string) {
+	for len(nick) > 0 && strings.IndexByte(sigils, nick[0]) >= 0 {
+		prefixModes += string(modes[strings.IndexByte(sigils, nick[0])])
+		nick = nick[1:]
+	}
+	return prefixModes, nick
+}
+
+// Part removes nick from channel, for PART.
+func (t *Tracker) Part(channelName, nick string) (*Channel, *ChannelUser) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.live(channelName)
+	if c == nil {
+		return nil, nil
+	}
+	key := t.fold(nick)
+	u := c.users[key]
+	delete(c.users, key)
+	if len(c.users) == 0 {
+		delete(t.channels, t.fold(channelName))
+	}
+	return c, u
+}
+
+// Kick removes nick from channel, for KICK; behaves like Part from the
+// tracker's point of view.
+func (t *Tracker) Kick(channelName, nick string) (*Channel, *ChannelUser) {
+	return t.Part(channelName, nick)
+}
+
+// QuitEntry is one channel a quitting user was seen in, returned by Quit so
+// the caller can fire a per-channel channel-part/user-quit event.
+type QuitEntry struct {
+	Channel *Channel
+	User    *ChannelUser
+}
+
+// Quit removes nick from every channel it was seen in, for QUIT.
+func (t *Tracker) Quit(nick string) []QuitEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := t.fold(nick)
+	var entries []QuitEntry
+
+	for name, c := range t.channels {
+		u, ok := c.users[key]
+		if !ok {
+			continue
+		}
+		delete(c.users, key)
+		entries = append(entries, QuitEntry{Channel: c, User: u})
+		if len(c.users) == 0 {
+			delete(t.channels, name)
+		}
+	}
+	return entries
+}
+
+// Nick renames a user across every channel it's seen in, for NICK.
+func (t *Tracker) Nick(oldNick, newNick string) []*Channel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	oldKey := t.fold(oldNick)
+	newKey := t.fold(newNick)
+
+	var changed []*Channel
+	for _, c := range t.channels {
+		u, ok := c.users[oldKey]
+		if !ok {
+			continue
+		}
+		u.Nick = newNick
+		delete(c.users, oldKey)
+		c.users[newKey] = u
+		changed = append(changed, c)
+	}
+	return changed
+}
+
+// Topic records channel's topic, for TOPIC or 332 RPL_TOPIC.
+func (t *Tracker) Topic(channelName, topic string) *Channel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.channel(channelName)
+	c.Topic = topic
+	return c
+}
+
+// Names applies one 353 RPL_NAMREPLY's worth of nicks to channel. names is
+// the space-separated nick list, each optionally prefixed with mode sigils
+// (multi-prefix) and, when userhost-in-names is negotiated, in
+// nick!user@host form. Sigils are stripped before the userhost split, so the
+// two combine correctly (e.g. "@dan!d@h").
+func (t *Tracker) Names(channelName string, names []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	modes, sigils := t.prefixes()
+	c := t.channel(channelName)
+	for _, entry := range names {
+		prefixModes, rest := stripSigils(entry, modes, sigils)
+		nick, user, host := splitUserhost(rest)
+		c.users[t.fold(nick)] = &ChannelUser{Nick: nick, User: user, Host: host, Modes: prefixModes, LastSeen: time.Now()}
+	}
+}
+
+// splitUserhost splits a userhost-in-names NAMES token ("nick!user@host")
+// into its parts; nick-only tokens return empty user/host.
+func splitUserhost(token string) (nick, user, host string) {
+	bang := strings.IndexByte(token, '!')
+	at := strings.IndexByte(token, '@')
+	if bang < 0 || at < 0 || bang > at {
+		return token, "", ""
+	}
+	return token[:bang], token[bang+1 : at], token[at+1:]
+}
+
+// Mode applies a channel MODE change affecting prefix modes (e.g. +o, -v)
+// to the given nick, for MODE. Non-prefix mode letters are the caller's
+// responsibility to interpret (e.g. ban lists); Mode is a no-op for them.
+func (t *Tracker) Mode(channelName string, add bool, mode byte, nick string) *ChannelUser {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	modes, _ := t.prefixes()
+	if strings.IndexByte(modes, mode) < 0 {
+		return nil
+	}
+
+	c := t.live(channelName)
+	if c == nil {
+		return nil
+	}
+	u := c.users[t.fold(nick)]
+	if u == nil {
+		return nil
+	}
+
+	if add {
+		if !u.HasMode(mode) {
+			// rebuild in PREFIX rank order, keeping Modes highest rank first
+			var ordered string
+			for i := 0; i < len(modes); i++ {
+				if modes[i] == mode || u.HasMode(modes[i]) {
+					ordered += string(modes[i])
+				}
+			}
+			u.Modes = ordered
+		}
+	} else {
+		u.Modes = strings.ReplaceAll(u.Modes, string(mode), "")
+	}
+	return u
+}
+
+// Away sets or clears a user's away status everywhere it's seen, for
+// away-notify.
+func (t *Tracker) Away(nick string, away bool) []*ChannelUser {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := t.fold(nick)
+	var affected []*ChannelUser
+	for _, c := range t.channels {
+		if u, ok := c.users[key]; ok {
+			u.Away = away
+			affected = append(affected, u)
+		}
+	}
+	return affected
+}
+
+// Account updates a user's account name everywhere it's seen, for
+// account-notify ("*" means logged out).
+func (t *Tracker) Account(nick, account string) []*ChannelUser {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := t.fold(nick)
+	var affected []*ChannelUser
+	for _, c := range t.channels {
+		if u, ok := c.users[key]; ok {
+			u.Account = account
+			affected = append(affected, u)
+		}
+	}
+	return affected
+}
+
+// ChgHost updates a user's user/host everywhere it's seen, for chghost.
+func (t *Tracker) ChgHost(nick, user, host string) []*ChannelUser {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := t.fold(nick)
+	var affected []*ChannelUser
+	for _, c := range t.channels {
+		if u, ok := c.users[key]; ok {
+			u.User = user
+			u.Host = host
+			affected = append(affected, u)
+		}
+	}
+	return affected
+}
@@ -0,0 +1,154 @@
+// written by Daniel Oaks <daniel@danieloaks.net>
+// released under the ISC license
+
+package tracker
+
+import "testing"
+
+func TestJoinAndPart(t *testing.T) {
+	var tr Tracker
+
+	c, u := tr.Join("#ircv3", "dan", "d", "example.com", "")
+	if c.Name != "#ircv3" || u.Nick != "dan" {
+		t.Fatalf("Join returned %+v, %+v", c, u)
+	}
+	if got := tr.Channel("#IRCV3"); got == nil || got.User("DAN") == nil {
+		t.Fatal("Channel/User lookup is not case-insensitive by default")
+	}
+
+	gotC, gotU := tr.Part("#ircv3", "dan")
+	if gotC == nil || gotU.Nick != "dan" {
+		t.Fatalf("Part returned %+v, %+v", gotC, gotU)
+	}
+	if tr.Channel("#ircv3") != nil {
+		t.Error("channel should have been dropped once its last member parted")
+	}
+}
+
+func TestJoinStripsPrefixSigils(t *testing.T) {
+	var tr Tracker
+	_, u := tr.Join("#ircv3", "@dan", "d", "example.com", "")
+	if u.Nick != "dan" {
+		t.Errorf("Nick = %q, want %q", u.Nick, "dan")
+	}
+	if !u.HasMode('o') {
+		t.Error("HasMode('o') = false, want true after joining with an @ prefix")
+	}
+}
+
+func TestNamesHandlesMultiPrefixAndUserhost(t *testing.T) {
+	var tr Tracker
+	tr.Names("#ircv3", []string{"@dan!d@h", "+other!o@h2", "plain!p@h3"})
+
+	c := tr.Channel("#ircv3")
+	if c == nil {
+		t.Fatal("Names did not create the channel")
+	}
+
+	u := c.User("dan")
+	if u == nil {
+		t.Fatal("dan not found")
+	}
+	if u.User != "d" || u.Host != "h" {
+		t.Errorf("dan User/Host = %q/%q, want %q/%q", u.User, u.Host, "d", "h")
+	}
+	if !u.HasMode('o') {
+		t.Error("HasMode('o') = false, want true for a @-prefixed NAMES entry")
+	}
+
+	other := c.User("other")
+	if other == nil || other.User != "o" || other.Host != "h2" || !other.HasMode('v') {
+		t.Errorf("other = %+v, want User=o Host=h2 with +v", other)
+	}
+
+	plain := c.User("plain")
+	if plain == nil || plain.User != "p" || plain.Host != "h3" || plain.Modes != "" {
+		t.Errorf("plain = %+v, want User=p Host=h3 with no modes", plain)
+	}
+}
+
+func TestQuitRemovesFromEveryChannel(t *testing.T) {
+	var tr Tracker
+	tr.Join("#a", "dan", "d", "h", "")
+	tr.Join("#b", "dan", "d", "h", "")
+	tr.Join("#b", "other", "o", "h", "")
+
+	entries := tr.Quit("dan")
+	if len(entries) != 2 {
+		t.Fatalf("Quit returned %d entries, want 2", len(entries))
+	}
+	if tr.Channel("#a") != nil {
+		t.Error("#a should have been dropped, dan was its only member")
+	}
+	if c := tr.Channel("#b"); c == nil || c.User("other") == nil {
+		t.Error("#b should still exist with its remaining member")
+	}
+}
+
+func TestNickRenamesAcrossChannels(t *testing.T) {
+	var tr Tracker
+	tr.Join("#a", "dan", "d", "h", "")
+	tr.Join("#b", "dan", "d", "h", "")
+
+	changed := tr.Nick("dan", "daniel")
+	if len(changed) != 2 {
+		t.Fatalf("Nick changed %d channels, want 2", len(changed))
+	}
+	if tr.Channel("#a").User("dan") != nil {
+		t.Error("old nick should no longer be present")
+	}
+	if u := tr.Channel("#a").User("daniel"); u == nil || u.Nick != "daniel" {
+		t.Error("new nick should be present with the updated Nick field")
+	}
+}
+
+func TestModeAddAndRemove(t *testing.T) {
+	var tr Tracker
+	tr.Join("#a", "dan", "d", "h", "")
+
+	u := tr.Mode("#a", true, 'o', "dan")
+	if u == nil || !u.HasMode('o') {
+		t.Fatal("Mode(+o) did not apply")
+	}
+
+	u = tr.Mode("#a", false, 'o', "dan")
+	if u == nil || u.HasMode('o') {
+		t.Fatal("Mode(-o) did not remove the mode")
+	}
+}
+
+func TestTopic(t *testing.T) {
+	var tr Tracker
+	tr.Topic("#a", "hello world")
+	if c := tr.Channel("#a"); c == nil || c.Topic != "hello world" {
+		t.Fatalf("Topic = %+v, want %q", c, "hello world")
+	}
+}
+
+func TestChannelsAndChannelReturnIndependentSnapshots(t *testing.T) {
+	var tr Tracker
+	tr.Join("#a", "dan", "d", "h", "")
+
+	snap := tr.Channel("#a")
+	tr.Join("#a", "other", "o", "h", "")
+
+	if len(snap.Users()) != 1 {
+		t.Errorf("snapshot should not observe joins after it was taken, got %d users", len(snap.Users()))
+	}
+	if len(tr.Channel("#a").Users()) != 2 {
+		t.Error("a fresh snapshot should observe the new member")
+	}
+}
+
+func TestCaseFoldOverride(t *testing.T) {
+	var tr Tracker
+	tr.CaseFold = func(s string) string { return s } // case-sensitive
+
+	tr.Join("#A", "dan", "d", "h", "")
+	if tr.Channel("#a") != nil {
+		t.Error("custom CaseFold should make #A and #a distinct channels")
+	}
+	if tr.Channel("#A") == nil {
+		t.Error("custom CaseFold should still find the channel by its exact name")
+	}
+}